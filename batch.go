@@ -0,0 +1,317 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"maunium.net/go/mautrix"
+)
+
+const (
+	// highWaterMark is the number of queued messages for a single room that
+	// triggers an immediate flush, rather than waiting for the next tick.
+	highWaterMark = 50
+
+	maxSendRetries     = 5
+	initialSendBackoff = 500 * time.Millisecond
+	maxSendBackoff     = 30 * time.Second
+)
+
+// routedEntry is a formatted message destined for a single room, as queued
+// by Fire for the dispatcher goroutine to batch.
+type routedEntry struct {
+	roomID string
+	entry  formattedEntry
+}
+
+// routedBatch is a room's batch of messages that failed to send, fed back
+// to the dispatcher so it can be retried on the next flush.
+type routedBatch struct {
+	roomID string
+	batch  []formattedEntry
+}
+
+// closeRequest is sent to the dispatcher goroutine by Close.
+type closeRequest struct {
+	ctx    context.Context
+	result chan map[string][]formattedEntry
+}
+
+// Fire evaluates e against every Route and enqueues the rendered message for
+// each matching room. The send to the dispatcher's queue is non-blocking, so
+// a slow matrix.org homeserver never blocks the logrus caller.
+func (matrusHook *MHook) Fire(e *logrus.Entry) error {
+	var threadKey string
+	if matrusHook.ThreadKeyFunc != nil {
+		threadKey = matrusHook.ThreadKeyFunc(e)
+	}
+
+	for _, route := range matrusHook.Router.Routes {
+		if !route.matches(e) {
+			continue
+		}
+
+		raw, err := route.render(e, matrusHook.formatter)
+		if err != nil || len(raw) == 0 {
+			continue
+		}
+
+		var fe formattedEntry
+		if err := json.Unmarshal(raw, &fe); err != nil {
+			continue
+		}
+		fe.ThreadKey = threadKey
+		fe.IsInfo = e.Level == logrus.InfoLevel
+		fe.IsError = e.Level <= logrus.ErrorLevel
+
+		select {
+		case matrusHook.queue <- routedEntry{roomID: route.RoomID, entry: fe}:
+		default:
+			// The queue is full: drop the message rather than block the
+			// caller. This mirrors the previous best-effort behaviour,
+			// just without the data race.
+		}
+	}
+	return nil
+}
+
+// Close stops the batch dispatcher and flushes any pending messages within
+// ctx's deadline. It returns any entries, by room, that had not been sent
+// when ctx expired, so callers - typically short-lived CLIs, or code
+// handling a FatalLevel/PanicLevel entry that is about to exit the process
+// - can decide whether to retry or give up on them.
+//
+// Close is safe to call more than once, including concurrently: the
+// dispatcher is only ever asked to close once, and every call (including
+// ones made after it has already finished) returns the same result rather
+// than blocking forever on a dispatcher that has already exited.
+func (matrusHook *MHook) Close(ctx context.Context) map[string][]formattedEntry {
+	matrusHook.closeOnce.Do(func() {
+		result := make(chan map[string][]formattedEntry, 1)
+		matrusHook.closeCh <- closeRequest{ctx: ctx, result: result}
+		matrusHook.closeResult = <-result
+		close(matrusHook.closeDone)
+	})
+	<-matrusHook.closeDone
+	return matrusHook.closeResult
+}
+
+// dispatch is the sole owner of roomBatches: it batches incoming entries,
+// flushes them on a tick or once a room crosses highWaterMark, and retries
+// failed sends with backoff. Running everything through one goroutine means
+// Fire can enqueue without a mutex.
+func (matrusHook *MHook) dispatch() {
+	for {
+		select {
+		case re := <-matrusHook.queue:
+			batch := append(matrusHook.roomBatches[re.roomID], re.entry)
+			matrusHook.roomBatches[re.roomID] = batch
+			if len(batch) >= highWaterMark {
+				matrusHook.flushRoom(context.Background(), re.roomID)
+			}
+
+		case fb := <-matrusHook.failed:
+			// Put the failed batch back in front of anything queued since.
+			matrusHook.roomBatches[fb.roomID] = append(fb.batch, matrusHook.roomBatches[fb.roomID]...)
+
+		case tu := <-matrusHook.threadUpdates:
+			matrusHook.applyThreadUpdate(tu)
+
+		case <-matrusHook.batchTicker.C:
+			matrusHook.flushAll(context.Background())
+
+		case req := <-matrusHook.closeCh:
+			matrusHook.closeAndFlush(req)
+			return
+		}
+	}
+}
+
+// closeAndFlush handles a closeRequest: it stops the ticker, drains the
+// queue, flushes every room and waits (up to req.ctx's deadline) for those
+// sends - including their retries - to finish before replying.
+func (matrusHook *MHook) closeAndFlush(req closeRequest) {
+	matrusHook.batchTicker.Stop()
+	matrusHook.drainQueue()
+	matrusHook.flushAll(req.ctx)
+
+	flushed := make(chan struct{})
+	go func() {
+		matrusHook.wg.Wait()
+		close(flushed)
+	}()
+
+	for {
+		select {
+		case fb := <-matrusHook.failed:
+			matrusHook.roomBatches[fb.roomID] = append(fb.batch, matrusHook.roomBatches[fb.roomID]...)
+		case tu := <-matrusHook.threadUpdates:
+			matrusHook.applyThreadUpdate(tu)
+		case <-flushed:
+			req.result <- matrusHook.roomBatches
+			return
+		case <-req.ctx.Done():
+			req.result <- matrusHook.roomBatches
+			return
+		}
+	}
+}
+
+// drainQueue moves any messages still sitting in the channel into
+// roomBatches without blocking, so a final flush sees everything Fire has
+// enqueued so far.
+func (matrusHook *MHook) drainQueue() {
+	for {
+		select {
+		case re := <-matrusHook.queue:
+			matrusHook.roomBatches[re.roomID] = append(matrusHook.roomBatches[re.roomID], re.entry)
+		default:
+			return
+		}
+	}
+}
+
+// flushAll starts a flush of every room with a non-empty batch.
+func (matrusHook *MHook) flushAll(ctx context.Context) {
+	if matrusHook.keyExchangePending {
+		// Key exchange for an encrypted room hasn't finished yet: keep
+		// buffering rather than dropping or sending unencrypted.
+		return
+	}
+
+	for roomID, batch := range matrusHook.roomBatches {
+		if len(batch) > 0 {
+			matrusHook.flushRoom(ctx, roomID)
+		}
+	}
+}
+
+// flushRoom takes ownership of roomID's current batch and sends it in the
+// background, so a slow or federated room never blocks the others. Entries
+// with no ThreadKey are joined into a single flat message as before;
+// entries sharing a ThreadKey are sent individually as a Matrix thread (see
+// thread.go). On failure (after retries) a batch is handed back to the
+// dispatcher via the failed channel rather than dropped.
+//
+// A key already being sent by an earlier flush is left in roomBatches
+// instead of started again: sendThreadedBatch only learns a thread's real
+// root once its goroutine finishes, so two concurrent sends for the same
+// key would each see a stale root and create two thread roots instead of
+// one.
+func (matrusHook *MHook) flushRoom(ctx context.Context, roomID string) {
+	batch := matrusHook.roomBatches[roomID]
+	if len(batch) == 0 {
+		return
+	}
+	delete(matrusHook.roomBatches, roomID)
+
+	var flat []formattedEntry
+	threaded := make(map[string][]formattedEntry)
+	for _, m := range batch {
+		switch {
+		case m.ThreadKey == "":
+			flat = append(flat, m)
+		case matrusHook.threadInFlight[roomID][m.ThreadKey]:
+			matrusHook.roomBatches[roomID] = append(matrusHook.roomBatches[roomID], m)
+		default:
+			threaded[m.ThreadKey] = append(threaded[m.ThreadKey], m)
+		}
+	}
+
+	if len(flat) > 0 {
+		matrusHook.sendFlatBatch(ctx, roomID, flat)
+	}
+	for key, entries := range threaded {
+		matrusHook.markThreadInFlight(roomID, key)
+		matrusHook.sendThreadedBatch(ctx, roomID, key, entries)
+	}
+}
+
+// markThreadInFlight records that roomID/key has a sendThreadedBatch
+// currently running, so a later flush defers rather than racing it.
+func (matrusHook *MHook) markThreadInFlight(roomID, key string) {
+	if matrusHook.threadInFlight[roomID] == nil {
+		matrusHook.threadInFlight[roomID] = make(map[string]bool)
+	}
+	matrusHook.threadInFlight[roomID][key] = true
+}
+
+// sendFlatBatch joins batch into a single <br/>-separated message and sends
+// it as one event, matrus' original (pre-threading) batching behaviour.
+func (matrusHook *MHook) sendFlatBatch(ctx context.Context, roomID string, batch []formattedEntry) {
+	htmlParts := make([]string, len(batch))
+	bodyParts := make([]string, len(batch))
+	for i, m := range batch {
+		htmlParts[i] = m.HTML
+		bodyParts[i] = m.Body
+	}
+
+	matrusHook.wg.Add(1)
+	go func() {
+		defer matrusHook.wg.Done()
+
+		err := sendWithBackoff(ctx, func() error {
+			return matrusHook._HTMLMessage(ctx, roomID, "m.text",
+				strings.Join(htmlParts, "<br/>"),
+				strings.Join(bodyParts, "\n"))
+		})
+		if err != nil {
+			matrusHook.failed <- routedBatch{roomID: roomID, batch: batch}
+		}
+	}()
+}
+
+// sendWithBackoff calls send up to maxSendRetries times in all, waiting with
+// exponential backoff after each failure. If the Matrix server rejects the request
+// with M_LIMIT_EXCEEDED, its retry_after_ms is honoured instead of the
+// computed backoff, per the Matrix spec's rate-limiting guidance.
+func sendWithBackoff(ctx context.Context, send func() error) error {
+	backoff := initialSendBackoff
+
+	var err error
+	for attempt := 0; attempt < maxSendRetries; attempt++ {
+		if err = send(); err == nil {
+			return nil
+		}
+
+		wait := backoff
+		var httpErr mautrix.HTTPError
+		if errors.As(err, &httpErr) && httpErr.RespError != nil && httpErr.RespError.ErrCode == "M_LIMIT_EXCEEDED" {
+			// retry_after_ms isn't a dedicated RespError field; it only ever
+			// arrives via the catch-all ExtraData map, as a JSON number.
+			if ms, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok {
+				wait = time.Duration(ms) * time.Millisecond
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > maxSendBackoff {
+			backoff = maxSendBackoff
+		}
+	}
+	return err
+}
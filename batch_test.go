@@ -0,0 +1,238 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// newTestHook returns an MHook pointed at an httptest server that accepts
+// any request and reports success, plus a func to tear the server down.
+func newTestHook(t *testing.T) (*MHook, func()) {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"event_id":"$test:localhost"}`))
+	}))
+
+	cli, err := mautrix.NewClient(server.URL, id.UserID("@matrus:localhost"), "test-token")
+	if err != nil {
+		server.Close()
+		t.Fatalf("mautrix.NewClient: %v", err)
+	}
+
+	hook, err := NewWithRoutes(cli, []Route{{MinLevel: logrus.InfoLevel, RoomID: "!room:localhost"}}, 1)
+	if err != nil {
+		server.Close()
+		t.Fatalf("NewWithRoutes: %v", err)
+	}
+
+	return hook, server.Close
+}
+
+func TestSendWithBackoffRetriesThenSucceeds(t *testing.T) {
+	attempts := 0
+	err := sendWithBackoff(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("sendWithBackoff() error = %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestSendWithBackoffGivesUpAfterMaxRetries(t *testing.T) {
+	attempts := 0
+	sendErr := errors.New("permanent failure")
+	err := sendWithBackoff(context.Background(), func() error {
+		attempts++
+		return sendErr
+	})
+	if !errors.Is(err, sendErr) {
+		t.Fatalf("sendWithBackoff() error = %v, want %v", err, sendErr)
+	}
+	if attempts != maxSendRetries {
+		t.Errorf("attempts = %d, want %d", attempts, maxSendRetries)
+	}
+}
+
+func TestSendWithBackoffRespectsContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts := 0
+	err := sendWithBackoff(ctx, func() error {
+		attempts++
+		return errors.New("always fails")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("sendWithBackoff() error = %v, want context.Canceled", err)
+	}
+	// The first attempt always runs before the context is consulted.
+	if attempts != 1 {
+		t.Errorf("attempts = %d, want 1", attempts)
+	}
+}
+
+func TestSendWithBackoffHonoursRetryAfterMS(t *testing.T) {
+	attempts := 0
+	start := time.Now()
+	err := sendWithBackoff(context.Background(), func() error {
+		attempts++
+		if attempts == 1 {
+			return mautrix.HTTPError{
+				RespError: &mautrix.RespError{
+					ErrCode:   "M_LIMIT_EXCEEDED",
+					ExtraData: map[string]interface{}{"retry_after_ms": float64(10)},
+				},
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("sendWithBackoff() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("sendWithBackoff() returned after %s, expected to honour RetryAfterMS", elapsed)
+	}
+	if elapsed := time.Since(start); elapsed > initialSendBackoff {
+		t.Errorf("sendWithBackoff() took %s, RetryAfterMS should have been used instead of the default backoff", elapsed)
+	}
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	hook, teardown := newTestHook(t)
+	defer teardown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	results := make([]map[string][]formattedEntry, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = hook.Close(ctx)
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() deadlocked when called concurrently/repeatedly")
+	}
+
+	// A sixth, strictly sequential call after the others have all finished
+	// must also return rather than block.
+	select {
+	case <-closeAndReturn(hook, ctx):
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() deadlocked when called after the dispatcher had already shut down")
+	}
+}
+
+// closeAndReturn runs hook.Close(ctx) in a goroutine and returns a channel
+// closed once it returns, so callers can bound how long they wait for it.
+func closeAndReturn(hook *MHook, ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		hook.Close(ctx)
+		close(done)
+	}()
+	return done
+}
+
+func TestFireIsConcurrencySafe(t *testing.T) {
+	hook, teardown := newTestHook(t)
+	defer teardown()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hook.Fire(&logrus.Entry{Level: logrus.InfoLevel, Message: "concurrent"})
+		}(i)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if leftover := hook.Close(ctx); len(leftover) != 0 {
+		t.Errorf("Close() left %d rooms with unsent messages, want 0", len(leftover))
+	}
+}
+
+func TestDispatchFlushesOnClose(t *testing.T) {
+	hook, teardown := newTestHook(t)
+	defer teardown()
+
+	if err := hook.Fire(&logrus.Entry{Level: logrus.InfoLevel, Message: "flush me"}); err != nil {
+		t.Fatalf("Fire() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	leftover := hook.Close(ctx)
+	if len(leftover) != 0 {
+		t.Errorf("Close() left %d rooms with unsent messages, want 0", len(leftover))
+	}
+}
+
+func TestFlushRoomDefersInFlightThreadKey(t *testing.T) {
+	hook := &MHook{
+		roomBatches:    make(map[string][]formattedEntry),
+		threadRoots:    make(map[string]map[string]id.EventID),
+		lastInfoEvent:  make(map[string]map[string]id.EventID),
+		threadInFlight: make(map[string]map[string]bool),
+	}
+	hook.markThreadInFlight("!room", "req-1")
+	hook.roomBatches["!room"] = []formattedEntry{{ThreadKey: "req-1", Body: "queued while in flight"}}
+
+	hook.flushRoom(context.Background(), "!room")
+
+	// sendThreadedBatch must not have been started for a key that already
+	// has a send in progress - the entry should simply stay queued for the
+	// next flush, once applyThreadUpdate clears the in-flight marker.
+	batch := hook.roomBatches["!room"]
+	if len(batch) != 1 || batch[0].Body != "queued while in flight" {
+		t.Errorf("roomBatches[!room] = %+v, want the entry left queued", batch)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// KeyRotationConfig controls how often a room's Megolm outbound session is
+// rotated. It is only consulted the first time NewEncrypted enables
+// encryption on a room that doesn't already have an m.room.encryption state
+// event: the values are written into that event, and OlmMachine (not matrus)
+// enforces them from then on for every device that respects the room's
+// stated policy, matrus' own device included.
+type KeyRotationConfig struct {
+	// Messages is the number of events after which a session is rotated.
+	Messages int
+	// Period is the maximum age of a session before it is rotated.
+	Period time.Duration
+}
+
+// defaultKeyRotation is used by NewEncrypted when no rotation config is given.
+var defaultKeyRotation = KeyRotationConfig{
+	Messages: 100,
+	Period:   7 * 24 * time.Hour,
+}
+
+// CryptoStore persists the Olm account, sessions and device/key state an
+// OlmMachine needs between restarts of a hook. It is mautrix-go's own
+// crypto.Store interface - not a matrus-specific one - so any mautrix-go
+// CryptoStore implementation (SQL, memory, ...) can be passed to
+// NewEncrypted directly.
+type CryptoStore = crypto.Store
+
+// NewMemoryCryptoStore returns a CryptoStore that keeps Olm/Megolm state in
+// memory only. It does not persist across restarts, so it is only suitable
+// for tests and short-lived CLIs where re-establishing sessions (and
+// re-sharing room keys with every device) on every run is acceptable. Unlike
+// NewSQLCryptoStore there is nothing to pickle to disk, so no pickle key is
+// needed here.
+func NewMemoryCryptoStore() CryptoStore {
+	return crypto.NewMemoryStore(nil)
+}
+
+// NewSQLCryptoStore wraps db as a CryptoStore backed by mautrix-go's own
+// crypto.SQLCryptoStore, for long-running deployments that need Olm/Megolm
+// state to survive restarts. accountID should uniquely identify cli's
+// account (e.g. its user ID) so that db can be shared by more than one
+// matrus hook.
+func NewSQLCryptoStore(db *sql.DB, dialect, accountID string, deviceID id.DeviceID, pickleKey []byte) (CryptoStore, error) {
+	wrapped, err := dbutil.NewWithDB(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	store := crypto.NewSQLCryptoStore(wrapped, dbutil.NoopLogger, accountID, deviceID, pickleKey)
+	if err := store.DB.Upgrade(context.Background()); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// memberStateStore is the crypto.StateStore OlmMachine needs to decide who
+// and what to encrypt to. matrus doesn't otherwise track room state, so this
+// is populated from the single full-state sync setupCrypto performs, rather
+// than kept live via incremental /sync like a full Matrix client would.
+type memberStateStore struct {
+	mu         sync.RWMutex
+	members    map[id.RoomID][]id.UserID
+	encryption map[id.RoomID]*event.EncryptionEventContent
+}
+
+func newMemberStateStore() *memberStateStore {
+	return &memberStateStore{
+		members:    make(map[id.RoomID][]id.UserID),
+		encryption: make(map[id.RoomID]*event.EncryptionEventContent),
+	}
+}
+
+// putRoom records roomID's joined members and encryption settings, as learnt
+// from a full-state sync.
+func (s *memberStateStore) putRoom(roomID id.RoomID, members []id.UserID, enc *event.EncryptionEventContent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.members[roomID] = members
+	s.encryption[roomID] = enc
+}
+
+// roomMembers returns roomID's joined members, as last learnt from a
+// full-state sync, for re-sharing a Megolm session once its predecessor has
+// expired.
+func (s *memberStateStore) roomMembers(roomID id.RoomID) []id.UserID {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.members[roomID]
+}
+
+// IsEncrypted implements crypto.StateStore
+func (s *memberStateStore) IsEncrypted(ctx context.Context, roomID id.RoomID) (bool, error) {
+	enc, err := s.GetEncryptionEvent(ctx, roomID)
+	return enc != nil, err
+}
+
+// GetEncryptionEvent implements crypto.StateStore
+func (s *memberStateStore) GetEncryptionEvent(_ context.Context, roomID id.RoomID) (*event.EncryptionEventContent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.encryption[roomID], nil
+}
+
+// FindSharedRooms implements crypto.StateStore
+func (s *memberStateStore) FindSharedRooms(_ context.Context, userID id.UserID) ([]id.RoomID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var rooms []id.RoomID
+	for roomID, members := range s.members {
+		for _, member := range members {
+			if member == userID {
+				rooms = append(rooms, roomID)
+				break
+			}
+		}
+	}
+	return rooms, nil
+}
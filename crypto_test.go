@@ -0,0 +1,74 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestNewMemoryCryptoStore(t *testing.T) {
+	store := NewMemoryCryptoStore()
+	if store == nil {
+		t.Fatal("NewMemoryCryptoStore() returned nil")
+	}
+}
+
+func TestMemberStateStore(t *testing.T) {
+	const roomA id.RoomID = "!a:localhost"
+	const roomB id.RoomID = "!b:localhost"
+	const alice id.UserID = "@alice:localhost"
+	const bob id.UserID = "@bob:localhost"
+
+	ctx := context.Background()
+	store := newMemberStateStore()
+
+	if enc, err := store.IsEncrypted(ctx, roomA); enc || err != nil {
+		t.Errorf("IsEncrypted() = (%v, %v) for a room with no recorded state, want (false, nil)", enc, err)
+	}
+	if got, err := store.GetEncryptionEvent(ctx, roomA); got != nil || err != nil {
+		t.Errorf("GetEncryptionEvent() = (%+v, %v), want (nil, nil)", got, err)
+	}
+	if rooms, err := store.FindSharedRooms(ctx, alice); len(rooms) != 0 || err != nil {
+		t.Errorf("FindSharedRooms() = (%v, %v), want (none, nil)", rooms, err)
+	}
+
+	enc := &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}
+	store.putRoom(roomA, []id.UserID{alice, bob}, enc)
+	store.putRoom(roomB, []id.UserID{alice}, nil)
+
+	if got, err := store.IsEncrypted(ctx, roomA); !got || err != nil {
+		t.Errorf("IsEncrypted(roomA) = (%v, %v), want (true, nil)", got, err)
+	}
+	if got, err := store.IsEncrypted(ctx, roomB); got || err != nil {
+		t.Errorf("IsEncrypted(roomB) = (%v, %v), want (false, nil) (no encryption event recorded)", got, err)
+	}
+	if got, err := store.GetEncryptionEvent(ctx, roomA); got != enc || err != nil {
+		t.Errorf("GetEncryptionEvent(roomA) = (%+v, %v), want (%+v, nil)", got, err, enc)
+	}
+
+	rooms, err := store.FindSharedRooms(ctx, alice)
+	if err != nil || len(rooms) != 2 {
+		t.Fatalf("FindSharedRooms(alice) = (%v, %v), want (2 rooms, nil)", rooms, err)
+	}
+
+	bobRooms, err := store.FindSharedRooms(ctx, bob)
+	if err != nil || len(bobRooms) != 1 || bobRooms[0] != roomA {
+		t.Errorf("FindSharedRooms(bob) = (%v, %v), want ([%s], nil)", bobRooms, err, roomA)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	gohtml "html"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/html"
+	"maunium.net/go/mautrix/format"
+)
+
+// formattedEntry is the structured payload produced by matrus' Formatter
+// implementations. It carries both the Matrix custom-HTML rendering of an
+// entry and a plain-text fallback body, so the dispatcher never has to fall
+// back to raw markup for clients that can't render HTML.
+type formattedEntry struct {
+	HTML string `json:"html"`
+	Body string `json:"body"`
+
+	// ThreadKey, IsInfo and IsError are set by Fire (not the Formatter) and
+	// used by the dispatcher to group entries into Matrix threads; see
+	// MHook.ThreadKeyFunc.
+	ThreadKey string
+	IsInfo    bool
+	IsError   bool
+}
+
+// levelColor maps a logrus level to the font colour matrus has historically
+// used to highlight it in Element and other matrix.org clients.
+func levelColor(level logrus.Level) string {
+	switch level {
+	case logrus.WarnLevel:
+		return "orange"
+	case logrus.InfoLevel:
+		return "green"
+	case logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel:
+		return "red"
+	default:
+		return "lightblue"
+	}
+}
+
+// entryFields renders e.Data (other than the reserved "msg" key) as a
+// comma-separated "key=value" list.
+func entryFields(e *logrus.Entry) string {
+	var data string
+	for k, v := range e.Data {
+		if k != "msg" {
+			data += k + "=" + fmt.Sprint(v) + ", "
+		}
+	}
+	return strings.TrimSuffix(data, ", ")
+}
+
+// HTMLFormatter formats logrus entries as the Matrix custom-HTML subset
+// directly, matching matrus' original wire format.
+type HTMLFormatter struct{}
+
+// Format implements logrus.Formatter
+func (f *HTMLFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	data := gohtml.EscapeString(entryFields(e))
+	msgBody := gohtml.EscapeString(strings.TrimSpace(e.Message))
+
+	if data == "" && msgBody == "" {
+		return nil, errors.New("Empty logging event")
+	}
+
+	htmlMsg := fmt.Sprintf(`<font color="%s">`, levelColor(e.Level))
+	if data != "" {
+		htmlMsg += "[" + data + "] - "
+	}
+	if msgBody != "" {
+		htmlMsg += fmt.Sprintf(`<b>%s</b>`, msgBody)
+	}
+	htmlMsg += `</font>`
+
+	return json.Marshal(formattedEntry{
+		HTML: htmlMsg,
+		Body: htmlToText(htmlMsg),
+	})
+}
+
+// MarkdownFormatter lets callers submit log messages as CommonMark Markdown,
+// rendering them to the Matrix custom-HTML subset (and a matching plain-text
+// body) via mautrix's format package.
+type MarkdownFormatter struct{}
+
+// Format implements logrus.Formatter
+func (f *MarkdownFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	md := entryMarkdown(e)
+	if md == "" {
+		return nil, errors.New("Empty logging event")
+	}
+
+	rendered := format.RenderMarkdown(md, true, false)
+
+	// mautrix leaves FormattedBody empty when the HTML would be identical to
+	// the plain-text body, so fall back to the escaped body in that case.
+	formatted := rendered.FormattedBody
+	if formatted == "" {
+		formatted = gohtml.EscapeString(rendered.Body)
+	}
+
+	return json.Marshal(formattedEntry{
+		HTML: fmt.Sprintf(`<font color="%s">%s</font>`, levelColor(e.Level), formatted),
+		Body: rendered.Body,
+	})
+}
+
+// entryMarkdown renders e as a single line of Markdown: its fields as an
+// inline code span, followed by its message.
+func entryMarkdown(e *logrus.Entry) string {
+	data := entryFields(e)
+	msgBody := strings.TrimSpace(e.Message)
+
+	switch {
+	case data == "" && msgBody == "":
+		return ""
+	case data == "":
+		return msgBody
+	case msgBody == "":
+		return codeSpan(data)
+	default:
+		return fmt.Sprintf("%s - %s", codeSpan(data), msgBody)
+	}
+}
+
+// codeSpan wraps s in a CommonMark inline code span, choosing a backtick run
+// one longer than the longest already in s (and padding with spaces, as the
+// spec requires when s starts/ends with a backtick) so that a field value
+// containing backticks can't close the span early and have the rest of the
+// entry rendered as live Markdown.
+func codeSpan(s string) string {
+	longestRun, run := 0, 0
+	for _, r := range s {
+		if r == '`' {
+			run++
+			if run > longestRun {
+				longestRun = run
+			}
+		} else {
+			run = 0
+		}
+	}
+
+	delim := strings.Repeat("`", longestRun+1)
+	if strings.HasPrefix(s, "`") || strings.HasSuffix(s, "`") {
+		return delim + " " + s + " " + delim
+	}
+	return delim + s + delim
+}
+
+// htmlToText renders a plain-text fallback body by walking htmlStr's node
+// tree, rather than reusing the raw markup as the body (which leaves
+// clients without HTML support showing unreadable tags).
+func htmlToText(htmlStr string) string {
+	doc, err := html.Parse(strings.NewReader(htmlStr))
+	if err != nil {
+		return htmlStr
+	}
+
+	var buf strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			buf.WriteString(n.Data)
+		case n.Data == "br":
+			buf.WriteString("\n")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestHTMLFormatterFormat(t *testing.T) {
+	entry := &logrus.Entry{
+		Level:   logrus.WarnLevel,
+		Message: "disk <almost> full",
+		Data:    logrus.Fields{"host": "db1"},
+	}
+
+	raw, err := (&HTMLFormatter{}).Format(entry)
+	if err != nil {
+		t.Fatalf("Format() error = %v", err)
+	}
+
+	var fe formattedEntry
+	if err := json.Unmarshal(raw, &fe); err != nil {
+		t.Fatalf("unmarshalling formatted entry: %v", err)
+	}
+	if !strings.Contains(fe.HTML, "&lt;almost&gt;") {
+		t.Errorf("HTML = %q, want escaped message content", fe.HTML)
+	}
+	if strings.Contains(fe.Body, "<font") || strings.Contains(fe.Body, "<b>") {
+		t.Errorf("Body = %q, want the markup walked away rather than left as raw tags", fe.Body)
+	}
+	if !strings.Contains(fe.Body, "disk <almost> full") {
+		t.Errorf("Body = %q, want the message text with entities resolved back to plain characters", fe.Body)
+	}
+}
+
+func TestHTMLFormatterFormatEmpty(t *testing.T) {
+	entry := &logrus.Entry{Data: logrus.Fields{}}
+
+	if _, err := (&HTMLFormatter{}).Format(entry); err == nil {
+		t.Error("Format() with no message or fields should return an error")
+	}
+}
+
+func TestMarkdownFormatterFormat(t *testing.T) {
+	entry := &logrus.Entry{Message: "**bold** reply"}
+
+	raw, err := (&MarkdownFormatter{}).Format(entry)
+	if err != nil {
+		t.Fatalf("Format() error = %v", err)
+	}
+
+	var fe formattedEntry
+	if err := json.Unmarshal(raw, &fe); err != nil {
+		t.Fatalf("unmarshalling formatted entry: %v", err)
+	}
+	if !strings.Contains(fe.HTML, "<strong>bold</strong>") {
+		t.Errorf("HTML = %q, want rendered Markdown", fe.HTML)
+	}
+	if fe.Body != "**bold** reply" {
+		t.Errorf("Body = %q, want the original Markdown source back as the plain-text fallback", fe.Body)
+	}
+}
+
+func TestMarkdownFormatterFormatEmpty(t *testing.T) {
+	entry := &logrus.Entry{Data: logrus.Fields{}}
+
+	if _, err := (&MarkdownFormatter{}).Format(entry); err == nil {
+		t.Error("Format() with no message or fields should return an error")
+	}
+}
+
+func TestEntryMarkdownEscapesBackticksInFields(t *testing.T) {
+	entry := &logrus.Entry{
+		Message: "went wrong",
+		Data:    logrus.Fields{"query": "`rm -rf /`"},
+	}
+
+	md := entryMarkdown(entry)
+
+	// The code span's delimiter must be longer than any backtick run it
+	// wraps, or the field value could close the span early and have the
+	// rest of the line rendered as live Markdown.
+	rendered := renderMarkdownHTML(t, md)
+	if strings.Contains(rendered, "<em>") || strings.Contains(rendered, "<strong>") {
+		t.Errorf("rendered = %q, want the field value left as literal text", rendered)
+	}
+}
+
+// renderMarkdownHTML renders md the same way MarkdownFormatter does,
+// returning the rendered HTML so tests can assert on what a client would
+// actually display.
+func renderMarkdownHTML(t *testing.T, md string) string {
+	t.Helper()
+	raw, err := (&MarkdownFormatter{}).Format(&logrus.Entry{Message: md})
+	if err != nil {
+		t.Fatalf("Format() error = %v", err)
+	}
+	var fe formattedEntry
+	if err := json.Unmarshal(raw, &fe); err != nil {
+		t.Fatalf("unmarshalling formatted entry: %v", err)
+	}
+	return fe.HTML
+}
+
+func TestCodeSpanChoosesLongerDelimiter(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "no backticks", in: "plain", want: "`plain`"},
+		{name: "single backtick", in: "a`b", want: "``a`b``"},
+		{name: "run of two", in: "a``b", want: "```a``b```"},
+		{name: "leading backtick", in: "`cmd", want: "`` `cmd ``"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span := codeSpan(tt.in)
+			if !strings.Contains(span, tt.in) {
+				t.Errorf("codeSpan(%q) = %q, want it to contain the original text", tt.in, span)
+			}
+			if span != tt.want {
+				t.Errorf("codeSpan(%q) = %q, want %q", tt.in, span, tt.want)
+			}
+		})
+	}
+}
+
+func TestHtmlToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{name: "strips tags", html: `<font color="red"><b>oops</b></font>`, want: "oops"},
+		{name: "br becomes newline", html: "first<br/>second", want: "first\nsecond"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlToText(tt.html); got != tt.want {
+				t.Errorf("htmlToText(%q) = %q, want %q", tt.html, got, tt.want)
+			}
+		})
+	}
+}
@@ -16,164 +16,315 @@
 package matrus
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"html"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/matrix-org/gomatrix"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 const (
 	// defaultBatchPeriod defines the default interval at which messages should be
 	// ispatched to the matrix.org logging room
 	defaultBatchPeriod = 15   // seconds
-	maxQueuedMessages  = 1000 // Max number of logging messages to buffer
+	maxQueuedMessages  = 1000 // Max number of logging messages queued for the dispatcher, across all rooms
 )
 
-// MHook is a matrus Hook for logging messages to the specified matrix.org room
+// MHook is a matrus Hook for logging messages to one or more matrix.org rooms
 // MHook implements logrus.Hook interface
 type MHook struct {
-	AcceptedLevels  []logrus.Level
-	Client          *gomatrix.Client
-	LoggingRoomID   string
-	formatter       logrus.Formatter
-	batchedMessages []string
-	batchTicker     *time.Ticker
+	AcceptedLevels []logrus.Level
+	Client         *mautrix.Client
+	LoggingRoomID  string
+	DeviceID       string
+	Router         Router
+	formatter      logrus.Formatter
+	batchTicker    *time.Ticker
+
+	// ThreadKeyFunc, if set, groups entries sharing a key into a Matrix
+	// thread instead of a flat batched message; see thread.go. ReplyToErrors
+	// additionally makes ErrorLevel+ entries reply directly to the last
+	// InfoLevel entry sharing their key.
+	ThreadKeyFunc ThreadKeyFunc
+	ReplyToErrors bool
+
+	// Batching state. queue, failed, threadUpdates and closeCh are only
+	// ever read from by the dispatch goroutine; roomBatches, threadRoots,
+	// lastInfoEvent and threadInFlight are owned exclusively by it too,
+	// which is what lets Fire enqueue without locking.
+	queue          chan routedEntry
+	failed         chan routedBatch
+	threadUpdates  chan threadUpdate
+	closeCh        chan closeRequest
+	roomBatches    map[string][]formattedEntry
+	threadRoots    map[string]map[string]id.EventID
+	lastInfoEvent  map[string]map[string]id.EventID
+	threadInFlight map[string]map[string]bool
+	wg             sync.WaitGroup
+
+	// Close state. closeOnce ensures the dispatcher is only ever sent one
+	// closeRequest; closeDone and closeResult let every call to Close -
+	// including ones after the first has already completed - return the
+	// same result instead of blocking on a dispatcher that has exited.
+	closeOnce   sync.Once
+	closeDone   chan struct{}
+	closeResult map[string][]formattedEntry
+
+	// E2EE state. olmMachine is nil for hooks created with New/NewWithRoutes,
+	// in which case messages are sent as plain m.room.message events. Every
+	// field below is finalised by buildHook (and, for NewEncrypted,
+	// setupCrypto) before the dispatch goroutine is started, so dispatch
+	// never has to synchronise with a constructor mutating the hook out from
+	// under it.
+	olmMachine         *crypto.OlmMachine
+	stateStore         *memberStateStore
+	keyExchangePending bool
 }
 
-// New instance of matrus logger hook
-//  * "cli" - Gomatrix client instance
+// New instance of matrus logger hook, dispatching every accepted entry to a
+// single room. This is a convenience wrapper around NewWithRoutes for
+// backward compatibility with matrus' original single-room API.
+//  * "cli" - mautrix client instance
 //  * "loggingRoomID" - The matrix.org roomID to send logging events to
 //  * "level" - Events at this logging level or higher will be dispatched
 //  * "bp" - The interval in seconds at which batches of logging events will be dispatched to matrix.org
 //  (if < 1 the batch dispatch period is set to the default of 15s)
-func New(cli *gomatrix.Client, loggingRoomID string, level logrus.Level, bp int) (*MHook, error) {
-	if cli == nil {
-		return nil, errors.New("Invalid gomatrix client")
-	} else if loggingRoomID == "" {
+func New(cli *mautrix.Client, loggingRoomID string, level logrus.Level, bp int) (*MHook, error) {
+	if loggingRoomID == "" {
 		return nil, errors.New("Invalid matrix.org room ID")
 	}
 
+	return NewWithRoutes(cli, []Route{{MinLevel: level, RoomID: loggingRoomID}}, bp)
+}
+
+// NewWithRoutes creates a matrus Hook that dispatches each entry to every
+// matrix.org room whose Route matches it, similarly to how
+// matrix-alertmanager-receiver maps alerts to rooms. routes is evaluated in
+// order and must contain at least one entry; include a route with a nil
+// FieldMatchers and the lowest severity MinLevel you need as a catch-all.
+//  * "cli" - mautrix client instance
+//  * "routes" - Rules mapping logrus entries to matrix.org rooms
+//  * "bp" - The interval in seconds at which batches of logging events will be dispatched to matrix.org
+//  (if < 1 the batch dispatch period is set to the default of 15s)
+func NewWithRoutes(cli *mautrix.Client, routes []Route, bp int) (*MHook, error) {
+	hook, err := buildHook(cli, routes, bp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start the dispatcher goroutine that owns roomBatches and performs all
+	// sends, so Fire never blocks on (or races with) network I/O. This is
+	// the last step of construction: every field dispatch touches is already
+	// final by the time it starts.
+	go hook.dispatch()
+
+	return hook, nil
+}
+
+// buildHook validates routes and assembles an MHook without starting its
+// dispatch goroutine, so callers that still need to set up additional state
+// - NewEncrypted's crypto setup, currently the only one - can finish doing
+// so before dispatch is running and able to observe it.
+func buildHook(cli *mautrix.Client, routes []Route, bp int) (*MHook, error) {
+	if cli == nil {
+		return nil, errors.New("Invalid mautrix client")
+	} else if len(routes) == 0 {
+		return nil, errors.New("Invalid routes: at least one route is required")
+	}
+
+	// The hook-wide level filter is the union of every route's levels, i.e.
+	// the least severe (highest numeric) MinLevel amongst them.
+	minLevel := routes[0].MinLevel
+	for _, route := range routes {
+		if route.RoomID == "" {
+			return nil, errors.New("Invalid matrix.org room ID")
+		}
+		if route.MinLevel > minLevel {
+			minLevel = route.MinLevel
+		}
+	}
+
 	// Set the batch dispatcher period
 	if bp < 1 {
 		bp = defaultBatchPeriod
 	}
 
-	hook := MHook{
+	hook := &MHook{
 		Client:         cli,
-		LoggingRoomID:  loggingRoomID,
-		AcceptedLevels: logLevelsFrom(level),
-		formatter:      &matrixFormatter{},
+		LoggingRoomID:  routes[0].RoomID,
+		Router:         Router{Routes: routes},
+		AcceptedLevels: logLevelsFrom(minLevel),
+		formatter:      &HTMLFormatter{},
 		batchTicker:    time.NewTicker(time.Second * time.Duration(bp)),
+		queue:          make(chan routedEntry, maxQueuedMessages),
+		failed:         make(chan routedBatch),
+		threadUpdates:  make(chan threadUpdate),
+		closeCh:        make(chan closeRequest),
+		roomBatches:    make(map[string][]formattedEntry),
+		threadRoots:    make(map[string]map[string]id.EventID),
+		lastInfoEvent:  make(map[string]map[string]id.EventID),
+		threadInFlight: make(map[string]map[string]bool),
+		closeDone:      make(chan struct{}),
 	}
 
-	// Start periodic dispatcher
-	go func() {
-		for range hook.batchTicker.C {
-			hook.sendBatchedMessages()
-		}
-	}()
-
-	return &hook, nil
+	return hook, nil
 }
 
-// Levels gets the levels at which logging events should be sent to matrix.org
-func (matrusHook *MHook) Levels() []logrus.Level {
-	if matrusHook.AcceptedLevels == nil {
-		return allLevels
+// NewEncrypted creates a matrus Hook that posts end-to-end encrypted events
+// to the given matrix.org room, as is required for most private/internal
+// logging rooms. Encryption itself is handled entirely by mautrix-go's own
+// crypto.OlmMachine; matrus only wires it up and keeps it supplied with the
+// room membership it needs, via a full-state sync performed before the hook
+// starts dispatching.
+//  * "cli" - mautrix client instance, already logged in
+//  * "loggingRoomID" - The matrix.org roomID to send logging events to
+//  * "deviceID" - The device ID cli's access token was issued for
+//  * "pickleKey" - Must be non-empty; it is not passed on to store, which pickles with the key it was created with (see NewSQLCryptoStore)
+//  * "store" - CryptoStore used to persist the Olm account, sessions and device keys between restarts
+//  * "rotation" - Megolm session rotation parameters for loggingRoomID, used only the first time it is encrypted (zero value uses defaultKeyRotation)
+//  * "level" - Events at this logging level or higher will be dispatched
+//  * "bp" - The interval in seconds at which batches of logging events will be dispatched to matrix.org
+//  (if < 1 the batch dispatch period is set to the default of 15s)
+func NewEncrypted(cli *mautrix.Client, loggingRoomID, deviceID string, pickleKey []byte, store CryptoStore, rotation KeyRotationConfig, level logrus.Level, bp int) (*MHook, error) {
+	if deviceID == "" {
+		return nil, errors.New("Invalid device ID")
+	} else if len(pickleKey) == 0 {
+		return nil, errors.New("Invalid pickle key")
+	} else if store == nil {
+		return nil, errors.New("Invalid crypto store")
 	}
-	return matrusHook.AcceptedLevels
-}
-
-// Fire queues messages to be dispatched to the matrix.org logging room
-func (matrusHook *MHook) Fire(e *logrus.Entry) error {
-	htmlbytes, err := matrusHook.formatter.Format(e)
-	html := string(htmlbytes)
-	if err != nil || html == "" {
-		return nil
+	if rotation.Messages < 1 {
+		rotation = defaultKeyRotation
 	}
 
-	// Append new message
-	matrusHook.batchedMessages = append(matrusHook.batchedMessages, html)
-	// Truncate messages if larger than maxQueuedMessages
-	if len(matrusHook.batchedMessages) > maxQueuedMessages {
-		matrusHook.batchedMessages = matrusHook.batchedMessages[(len(matrusHook.batchedMessages) - maxQueuedMessages):]
+	hook, err := buildHook(cli, []Route{{MinLevel: level, RoomID: loggingRoomID}}, bp)
+	if err != nil {
+		return nil, err
 	}
-	return nil
-}
 
-// sendBatchedMessages periodically dispatches messages in to the matrix.org logging room
-func (matrusHook *MHook) sendBatchedMessages() (bool, error) {
-	if len(matrusHook.batchedMessages) > 0 {
-		if err := matrusHook._HTMLMessage("m.text",
-			strings.Join(matrusHook.batchedMessages, "<br/>"),
-			strings.Join(matrusHook.batchedMessages, "\n")); err == nil {
-			matrusHook.batchedMessages = make([]string, 0)
-		}
-		return true, err
-	}
-	return false, nil
-}
+	hook.DeviceID = deviceID
+	cli.DeviceID = id.DeviceID(deviceID)
+	hook.stateStore = newMemberStateStore()
+	hook.olmMachine = crypto.NewOlmMachine(cli, nil, store, hook.stateStore)
 
-// _HTMLMessage sends an HTML formatted message in to the matrix.org logging room
-func (matrusHook *MHook) _HTMLMessage(msgType, html, body string) error {
-	msg := gomatrix.GetHTMLMessage(msgType, html)
-	if body != "" {
-		msg.Body = body
+	if err := hook.setupCrypto(rotation); err != nil {
+		return nil, err
 	}
-	_, err := matrusHook.Client.SendMessageEvent(matrusHook.LoggingRoomID, "m.room.message",
-		msg)
-	return err
+
+	// Only now, with olmMachine/stateStore/keyExchangePending all settled,
+	// is it safe to let the dispatch goroutine start observing the hook.
+	go hook.dispatch()
+
+	return hook, nil
 }
 
-// matrixFormatter message formatter
-type matrixFormatter struct{}
+// setupCrypto loads (or creates) matrusHook's Olm account, performs the
+// full-state sync OlmMachine needs to learn the logging room's members and
+// encryption settings, uploads device/one-time keys and - if the room isn't
+// already encrypted - turns on encryption for it using rotation. While it
+// runs, the dispatcher buffers rather than sends queued messages.
+func (matrusHook *MHook) setupCrypto(rotation KeyRotationConfig) error {
+	matrusHook.keyExchangePending = true
+	defer func() { matrusHook.keyExchangePending = false }()
+
+	ctx := context.Background()
 
-// Format formats a message to send to matrix
-func (formatter *matrixFormatter) Format(e *logrus.Entry) ([]byte, error) {
-	var color string
+	if err := matrusHook.olmMachine.Load(ctx); err != nil {
+		return fmt.Errorf("matrus: failed to load Olm account: %s", err)
+	}
 
-	switch e.Level {
-	case logrus.WarnLevel:
-		color = "orange"
-	case logrus.InfoLevel:
-		color = "green"
-	case logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel:
-		color = "red"
-	default:
-		color = "lightblue"
+	resp, err := matrusHook.Client.FullSyncRequest(ctx, mautrix.ReqSync{FullState: true})
+	if err != nil {
+		return fmt.Errorf("matrus: full-state sync failed: %s", err)
 	}
 
-	htmlMsg := fmt.Sprintf(`<font color="%s">`, color)
+	roomID := id.RoomID(matrusHook.LoggingRoomID)
+	members, enc, err := roomMembersAndEncryption(resp, roomID)
+	if err != nil {
+		return err
+	}
 
-	var data string
-	for k, v := range e.Data {
-		if k != "msg" {
-			data += k + "=" + fmt.Sprint(v) + ", "
+	if enc == nil {
+		enc = &event.EncryptionEventContent{
+			Algorithm:              id.AlgorithmMegolmV1,
+			RotationPeriodMillis:   int64(rotation.Period / time.Millisecond),
+			RotationPeriodMessages: rotation.Messages,
 		}
+		if _, err := matrusHook.Client.SendStateEvent(ctx, roomID, event.StateEncryption, "", enc); err != nil {
+			return fmt.Errorf("matrus: failed to enable room encryption: %s", err)
+		}
+	}
+	matrusHook.stateStore.putRoom(roomID, members, enc)
+
+	if err := matrusHook.olmMachine.ShareKeys(ctx, resp.DeviceOTKCount.SignedCurve25519); err != nil {
+		return fmt.Errorf("matrus: failed to upload device/one-time keys: %s", err)
 	}
 
-	data = strings.TrimSuffix(data, ", ")
-	data = html.EscapeString(data)
+	return matrusHook.olmMachine.ShareGroupSession(ctx, roomID, members)
+}
 
-	msgBody := strings.TrimSpace(e.Message)
-	msgBody = html.EscapeString(msgBody)
+// roomMembersAndEncryption extracts roomID's joined member IDs and
+// m.room.encryption content (nil if the room isn't encrypted) from a full
+// sync response.
+func roomMembersAndEncryption(resp *mautrix.RespSync, roomID id.RoomID) ([]id.UserID, *event.EncryptionEventContent, error) {
+	room, ok := resp.Rooms.Join[roomID]
+	if !ok {
+		return nil, nil, fmt.Errorf("matrus: not joined to room %s", roomID)
+	}
 
-	if data == "" && msgBody == "" {
-		return nil, errors.New("Empty logging event")
+	var members []id.UserID
+	var enc *event.EncryptionEventContent
+	for _, ev := range room.State.Events {
+		switch {
+		case ev.Type == event.StateMember && ev.StateKey != nil:
+			if member := ev.Content.AsMember(); member != nil && member.Membership == event.MembershipJoin {
+				members = append(members, id.UserID(*ev.StateKey))
+			}
+		case ev.Type == event.StateEncryption:
+			enc = ev.Content.AsEncryption()
+		}
 	}
+	return members, enc, nil
+}
 
-	if data != "" {
-		htmlMsg += "[" + data + "] - "
+// Levels gets the levels at which logging events should be sent to matrix.org
+func (matrusHook *MHook) Levels() []logrus.Level {
+	if matrusHook.AcceptedLevels == nil {
+		return logrus.AllLevels
 	}
+	return matrusHook.AcceptedLevels
+}
 
-	if msgBody != "" {
-		htmlMsg += fmt.Sprintf(`<b>%s</b>`, msgBody)
+// logLevelsFrom returns every logrus.Level at minLevel or more severe, for
+// use as an MHook's AcceptedLevels.
+func logLevelsFrom(minLevel logrus.Level) []logrus.Level {
+	var levels []logrus.Level
+	for _, level := range logrus.AllLevels {
+		if level <= minLevel {
+			levels = append(levels, level)
+		}
 	}
+	return levels
+}
 
-	htmlMsg += `</font>`
-	return []byte(htmlMsg), nil
+// _HTMLMessage sends an HTML formatted message in to the given matrix.org room
+func (matrusHook *MHook) _HTMLMessage(ctx context.Context, roomID, msgType, html, body string) error {
+	msg := event.MessageEventContent{
+		MsgType:       event.MessageType(msgType),
+		Body:          body,
+		Format:        event.FormatHTML,
+		FormattedBody: html,
+	}
+	if body == "" {
+		msg.Body = html
+	}
+
+	_, err := matrusHook.sendRoomEvent(ctx, roomID, msg)
+	return err
 }
@@ -0,0 +1,149 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRoomMembersAndEncryption(t *testing.T) {
+	const roomID id.RoomID = "!room:localhost"
+	const alice id.UserID = "@alice:localhost"
+	const bob id.UserID = "@bob:localhost"
+
+	memberEvent := func(userID id.UserID, membership event.Membership) *event.Event {
+		stateKey := string(userID)
+		return &event.Event{
+			Type:     event.StateMember,
+			StateKey: &stateKey,
+			Content:  event.Content{Parsed: &event.MemberEventContent{Membership: membership}},
+		}
+	}
+	enc := &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}
+	encEvent := &event.Event{
+		Type:    event.StateEncryption,
+		Content: event.Content{Parsed: enc},
+	}
+
+	resp := &mautrix.RespSync{
+		Rooms: mautrix.RespSyncRooms{
+			Join: map[id.RoomID]*mautrix.SyncJoinedRoom{
+				roomID: {
+					State: mautrix.SyncEventsList{
+						Events: []*event.Event{
+							memberEvent(alice, event.MembershipJoin),
+							memberEvent(bob, event.MembershipLeave),
+							encEvent,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	members, gotEnc, err := roomMembersAndEncryption(resp, roomID)
+	if err != nil {
+		t.Fatalf("roomMembersAndEncryption() error = %v", err)
+	}
+	if len(members) != 1 || members[0] != alice {
+		t.Errorf("roomMembersAndEncryption() members = %v, want [%s] (bob left, so excluded)", members, alice)
+	}
+	if gotEnc != enc {
+		t.Errorf("roomMembersAndEncryption() enc = %+v, want %+v", gotEnc, enc)
+	}
+
+	if _, _, err := roomMembersAndEncryption(resp, "!notjoined:localhost"); err == nil {
+		t.Error("roomMembersAndEncryption() for a room that isn't joined = nil error, want an error")
+	}
+}
+
+// newFakeEncryptedServer returns an httptest server that mocks just enough
+// of the client-server API for NewEncrypted/setupCrypto to run end to end
+// without needing to exchange keys with other devices: a full-state sync
+// reporting no other room members and an already-encrypted room (so
+// SendStateEvent is never called), plus a device key upload.
+func newFakeEncryptedServer(t *testing.T, roomID id.RoomID) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/_matrix/client/v3/sync":
+			resp := mautrix.RespSync{
+				Rooms: mautrix.RespSyncRooms{
+					Join: map[id.RoomID]*mautrix.SyncJoinedRoom{
+						roomID: {
+							State: mautrix.SyncEventsList{
+								Events: []*event.Event{{
+									Type:    event.StateEncryption,
+									Content: event.Content{Parsed: &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}},
+								}},
+							},
+						},
+					},
+				},
+			}
+			json.NewEncoder(w).Encode(resp)
+		case r.Method == http.MethodPost && r.URL.Path == "/_matrix/client/v3/keys/upload":
+			json.NewEncoder(w).Encode(mautrix.RespUploadKeys{})
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/sendToDevice/"):
+			// ShareGroupSession always reports the new session via a
+			// to-device send, even to an empty set of devices.
+			json.NewEncoder(w).Encode(mautrix.RespSendToDevice{})
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			json.NewEncoder(w).Encode(map[string]string{"errcode": "M_UNRECOGNIZED"})
+		}
+	}))
+}
+
+func TestNewEncryptedSetsClientDeviceID(t *testing.T) {
+	const roomID id.RoomID = "!room:localhost"
+	const deviceID = "TESTDEVICE"
+
+	server := newFakeEncryptedServer(t, roomID)
+	defer server.Close()
+
+	cli, err := mautrix.NewClient(server.URL, id.UserID("@matrus:localhost"), "test-token")
+	if err != nil {
+		t.Fatalf("mautrix.NewClient: %v", err)
+	}
+
+	hook, err := NewEncrypted(cli, string(roomID), deviceID, []byte("pickle-key"), NewMemoryCryptoStore(), KeyRotationConfig{}, logrus.InfoLevel, 1)
+	if err != nil {
+		t.Fatalf("NewEncrypted() error = %v", err)
+	}
+	closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer hook.Close(closeCtx)
+
+	if cli.DeviceID != id.DeviceID(deviceID) {
+		t.Errorf("cli.DeviceID = %q, want %q - OlmMachine reads this field, not hook.DeviceID", cli.DeviceID, deviceID)
+	}
+	if hook.DeviceID != deviceID {
+		t.Errorf("hook.DeviceID = %q, want %q", hook.DeviceID, deviceID)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	gohtml "html"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Route describes one rule for dispatching a logrus entry to a matrix.org
+// room, similarly to how matrix-alertmanager-receiver maps alerts to rooms.
+// An entry matches a route if it is at MinLevel or more severe and its
+// Data contains every key/value pair in FieldMatchers. If Template is set
+// it is executed as a text/template against the entry to produce the
+// message sent to RoomID; otherwise the hook's default formatter is used.
+type Route struct {
+	MinLevel      logrus.Level
+	FieldMatchers map[string]string
+	RoomID        string
+	Template      string
+}
+
+// matches reports whether entry e satisfies route r.
+func (r Route) matches(e *logrus.Entry) bool {
+	if e.Level > r.MinLevel {
+		return false
+	}
+
+	for field, want := range r.FieldMatchers {
+		got, ok := e.Data[field]
+		if !ok || fmt.Sprint(got) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// render formats e for dispatch to r.RoomID, using r.Template if set or def
+// otherwise, returning the same formattedEntry wire format as a Formatter.
+func (r Route) render(e *logrus.Entry, def logrus.Formatter) ([]byte, error) {
+	if r.Template == "" {
+		return def.Format(e)
+	}
+
+	tmpl, err := template.New("route").Parse(r.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+
+	rendered := strings.TrimSpace(buf.String())
+	if rendered == "" {
+		return nil, errors.New("Empty logging event")
+	}
+
+	return json.Marshal(formattedEntry{
+		HTML: gohtml.EscapeString(rendered),
+		Body: rendered,
+	})
+}
+
+// Router dispatches logrus entries to zero or more matrix.org rooms based on
+// an ordered list of Routes. A single entry may match more than one route,
+// in which case it is sent to every matching room.
+type Router struct {
+	Routes []Route
+}
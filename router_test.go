@@ -0,0 +1,130 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+		entry *logrus.Entry
+		want  bool
+	}{
+		{
+			name:  "level too low",
+			route: Route{MinLevel: logrus.WarnLevel},
+			entry: &logrus.Entry{Level: logrus.InfoLevel},
+			want:  false,
+		},
+		{
+			name:  "level matches with no field matchers",
+			route: Route{MinLevel: logrus.WarnLevel},
+			entry: &logrus.Entry{Level: logrus.ErrorLevel},
+			want:  true,
+		},
+		{
+			name:  "field matcher satisfied",
+			route: Route{MinLevel: logrus.InfoLevel, FieldMatchers: map[string]string{"service": "billing"}},
+			entry: &logrus.Entry{Level: logrus.InfoLevel, Data: logrus.Fields{"service": "billing"}},
+			want:  true,
+		},
+		{
+			name:  "field matcher missing",
+			route: Route{MinLevel: logrus.InfoLevel, FieldMatchers: map[string]string{"service": "billing"}},
+			entry: &logrus.Entry{Level: logrus.InfoLevel, Data: logrus.Fields{}},
+			want:  false,
+		},
+		{
+			name:  "field matcher mismatched value",
+			route: Route{MinLevel: logrus.InfoLevel, FieldMatchers: map[string]string{"service": "billing"}},
+			entry: &logrus.Entry{Level: logrus.InfoLevel, Data: logrus.Fields{"service": "payments"}},
+			want:  false,
+		},
+		{
+			name:  "non-string field value is stringified",
+			route: Route{MinLevel: logrus.InfoLevel, FieldMatchers: map[string]string{"attempt": "3"}},
+			entry: &logrus.Entry{Level: logrus.InfoLevel, Data: logrus.Fields{"attempt": 3}},
+			want:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.route.matches(tt.entry); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteRenderDefaultFormatter(t *testing.T) {
+	route := Route{}
+	entry := &logrus.Entry{Level: logrus.InfoLevel, Message: "hello"}
+
+	raw, err := route.render(entry, &HTMLFormatter{})
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+
+	var fe formattedEntry
+	if err := json.Unmarshal(raw, &fe); err != nil {
+		t.Fatalf("unmarshalling rendered entry: %v", err)
+	}
+	if fe.Body == "" {
+		t.Error("render() produced an empty body")
+	}
+}
+
+func TestRouteRenderTemplate(t *testing.T) {
+	route := Route{Template: "{{.Message}}"}
+	entry := &logrus.Entry{Message: "custom rendered message"}
+
+	raw, err := route.render(entry, &HTMLFormatter{})
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+
+	var fe formattedEntry
+	if err := json.Unmarshal(raw, &fe); err != nil {
+		t.Fatalf("unmarshalling rendered entry: %v", err)
+	}
+	if fe.Body != "custom rendered message" {
+		t.Errorf("Body = %q, want %q", fe.Body, "custom rendered message")
+	}
+}
+
+func TestRouteRenderTemplateEmpty(t *testing.T) {
+	route := Route{Template: "  {{if false}}unreachable{{end}}  "}
+	entry := &logrus.Entry{Message: "ignored"}
+
+	if _, err := route.render(entry, &HTMLFormatter{}); err == nil {
+		t.Error("render() with an empty rendered template should return an error")
+	}
+}
+
+func TestRouteRenderInvalidTemplate(t *testing.T) {
+	route := Route{Template: "{{.Nope"}
+	entry := &logrus.Entry{Message: "ignored"}
+
+	if _, err := route.render(entry, &HTMLFormatter{}); err == nil {
+		t.Error("render() with an invalid template should return an error")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ThreadKeyFunc derives a grouping key from a logrus entry, e.g. a
+// "request_id" field or the entry's goroutine-local context. Entries that
+// share a key are sent as a Matrix thread: the first becomes the thread's
+// root event, and subsequent ones are sent as threaded replies to it
+// instead of being folded into the next flat batched message.
+type ThreadKeyFunc func(*logrus.Entry) string
+
+// threadUpdate reports the outcome of a sendThreadedBatch run back to the
+// dispatcher goroutine, which is the only thing allowed to mutate
+// threadRoots/lastInfoEvent.
+type threadUpdate struct {
+	roomID   string
+	key      string
+	root     id.EventID
+	lastInfo id.EventID
+}
+
+// applyThreadUpdate records the root and (if ReplyToErrors is set) latest
+// InfoLevel event IDs learnt by a completed sendThreadedBatch, and clears
+// its in-flight marker so the next flush is free to send tu.key again.
+func (matrusHook *MHook) applyThreadUpdate(tu threadUpdate) {
+	delete(matrusHook.threadInFlight[tu.roomID], tu.key)
+
+	if tu.root != "" {
+		if matrusHook.threadRoots[tu.roomID] == nil {
+			matrusHook.threadRoots[tu.roomID] = make(map[string]id.EventID)
+		}
+		matrusHook.threadRoots[tu.roomID][tu.key] = tu.root
+	}
+
+	if matrusHook.ReplyToErrors && tu.lastInfo != "" {
+		if matrusHook.lastInfoEvent[tu.roomID] == nil {
+			matrusHook.lastInfoEvent[tu.roomID] = make(map[string]id.EventID)
+		}
+		matrusHook.lastInfoEvent[tu.roomID][tu.key] = tu.lastInfo
+	}
+}
+
+// sendThreadedBatch sends entries - all sharing key - to roomID one at a
+// time in the background: the first becomes the thread root (or, if key
+// already has one from a previous flush, replies are threaded onto it
+// straight away), and later ones thread onto that root. Any entry that
+// still fails after sendWithBackoff's retries is handed back to the
+// dispatcher via the failed channel.
+func (matrusHook *MHook) sendThreadedBatch(ctx context.Context, roomID, key string, entries []formattedEntry) {
+	root := matrusHook.threadRoots[roomID][key]
+	lastInfo := matrusHook.lastInfoEvent[roomID][key]
+
+	matrusHook.wg.Add(1)
+	go func() {
+		defer matrusHook.wg.Done()
+
+		var unsent []formattedEntry
+		for _, m := range entries {
+			evtID, err := matrusHook.sendThreadedEntry(ctx, roomID, root, lastInfo, m)
+			if err != nil {
+				unsent = append(unsent, m)
+				continue
+			}
+
+			if root == "" {
+				root = evtID
+			}
+			if matrusHook.ReplyToErrors && m.IsInfo {
+				lastInfo = evtID
+			}
+		}
+
+		matrusHook.threadUpdates <- threadUpdate{roomID: roomID, key: key, root: root, lastInfo: lastInfo}
+		if len(unsent) > 0 {
+			matrusHook.failed <- routedBatch{roomID: roomID, batch: unsent}
+		}
+	}()
+}
+
+// threadRelatesTo builds the m.relates_to for m, given the thread's current
+// root and (if replyToErrors is set) the last InfoLevel event sent for its
+// key. It returns nil for the first entry in a not-yet-started thread.
+func threadRelatesTo(m formattedEntry, root, lastInfo id.EventID, replyToErrors bool) *event.RelatesTo {
+	switch {
+	case replyToErrors && m.IsError && lastInfo != "":
+		return &event.RelatesTo{
+			InReplyTo: &event.InReplyTo{EventID: lastInfo},
+		}
+	case root != "":
+		return &event.RelatesTo{
+			Type:      event.RelThread,
+			EventID:   root,
+			InReplyTo: &event.InReplyTo{EventID: root},
+		}
+	default:
+		return nil
+	}
+}
+
+// sendThreadedEntry sends m to roomID, relating it to an existing thread
+// (or starting a new one) as appropriate, and returns its event ID.
+//
+// If ReplyToErrors is set and m is an ErrorLevel+ entry with a known
+// lastInfo event, it is sent as a direct reply to that event rather than
+// threaded onto root, giving reviewers one-click context in clients like
+// Element. Otherwise, once root is known, m is sent with an m.relates_to of
+// rel_type m.thread, plus an m.in_reply_to fallback block for clients that
+// don't understand threads, mirroring mautrix's reply.go.
+func (matrusHook *MHook) sendThreadedEntry(ctx context.Context, roomID string, root, lastInfo id.EventID, m formattedEntry) (id.EventID, error) {
+	content := event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          m.Body,
+		Format:        event.FormatHTML,
+		FormattedBody: m.HTML,
+	}
+	content.RelatesTo = threadRelatesTo(m, root, lastInfo, matrusHook.ReplyToErrors)
+
+	var evtID id.EventID
+	err := sendWithBackoff(ctx, func() error {
+		sent, sendErr := matrusHook.sendRoomEvent(ctx, roomID, content)
+		if sendErr != nil {
+			return sendErr
+		}
+		evtID = sent
+		return nil
+	})
+	return evtID, err
+}
+
+// sendRoomEvent sends content as an m.room.message event to roomID -
+// encrypting it first, via olmMachine, if the hook has E2EE enabled - and
+// returns the resulting event ID.
+func (matrusHook *MHook) sendRoomEvent(ctx context.Context, roomID string, content interface{}) (id.EventID, error) {
+	if matrusHook.olmMachine != nil {
+		encrypted, err := matrusHook.encryptMegolmEvent(ctx, id.RoomID(roomID), content)
+		if err != nil {
+			return "", err
+		}
+		resp, err := matrusHook.Client.SendMessageEvent(ctx, id.RoomID(roomID), event.EventEncrypted, encrypted)
+		if err != nil {
+			return "", err
+		}
+		return resp.EventID, nil
+	}
+
+	resp, err := matrusHook.Client.SendMessageEvent(ctx, id.RoomID(roomID), event.EventMessage, content)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// encryptMegolmEvent encrypts content for roomID, re-sharing the room's
+// Megolm session and retrying once if olmMachine reports it as expired or
+// not yet shared. EncryptMegolmEvent never re-shares on its own - only
+// ShareGroupSession decides whether a new session is needed - so without
+// this a hook would keep re-using (or never find) a usable session for the
+// entirety of a long-running process. This mirrors mautrix-go's own
+// cryptohelper.CryptoHelper.Encrypt.
+func (matrusHook *MHook) encryptMegolmEvent(ctx context.Context, roomID id.RoomID, content interface{}) (*event.EncryptedEventContent, error) {
+	encrypted, err := matrusHook.olmMachine.EncryptMegolmEvent(ctx, roomID, event.EventMessage, content)
+	if err == nil || !crypto.IsShareError(err) {
+		return encrypted, err
+	}
+
+	members := matrusHook.stateStore.roomMembers(roomID)
+	if shareErr := matrusHook.olmMachine.ShareGroupSession(ctx, roomID, members); shareErr != nil {
+		return nil, fmt.Errorf("matrus: failed to re-share group session: %w", shareErr)
+	}
+	return matrusHook.olmMachine.EncryptMegolmEvent(ctx, roomID, event.EventMessage, content)
+}
@@ -0,0 +1,225 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matrus
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestThreadRelatesTo(t *testing.T) {
+	const root id.EventID = "$root"
+	const lastInfo id.EventID = "$lastinfo"
+
+	tests := []struct {
+		name          string
+		m             formattedEntry
+		root          id.EventID
+		lastInfo      id.EventID
+		replyToErrors bool
+		want          *event.RelatesTo
+	}{
+		{
+			name: "first entry in a thread has no relation yet",
+			m:    formattedEntry{},
+			want: nil,
+		},
+		{
+			name: "subsequent entry threads onto root",
+			m:    formattedEntry{},
+			root: root,
+			want: &event.RelatesTo{
+				Type:      event.RelThread,
+				EventID:   root,
+				InReplyTo: &event.InReplyTo{EventID: root},
+			},
+		},
+		{
+			name:          "error entry replies to last info event when ReplyToErrors is set",
+			m:             formattedEntry{IsError: true},
+			root:          root,
+			lastInfo:      lastInfo,
+			replyToErrors: true,
+			want: &event.RelatesTo{
+				InReplyTo: &event.InReplyTo{EventID: lastInfo},
+			},
+		},
+		{
+			name:          "error entry threads as normal when ReplyToErrors is unset",
+			m:             formattedEntry{IsError: true},
+			root:          root,
+			lastInfo:      lastInfo,
+			replyToErrors: false,
+			want: &event.RelatesTo{
+				Type:      event.RelThread,
+				EventID:   root,
+				InReplyTo: &event.InReplyTo{EventID: root},
+			},
+		},
+		{
+			name:          "error entry with no known lastInfo threads as normal",
+			m:             formattedEntry{IsError: true},
+			root:          root,
+			replyToErrors: true,
+			want: &event.RelatesTo{
+				Type:      event.RelThread,
+				EventID:   root,
+				InReplyTo: &event.InReplyTo{EventID: root},
+			},
+		},
+		{
+			name:          "non-error entry ignores lastInfo even when ReplyToErrors is set",
+			m:             formattedEntry{IsError: false},
+			root:          root,
+			lastInfo:      lastInfo,
+			replyToErrors: true,
+			want: &event.RelatesTo{
+				Type:      event.RelThread,
+				EventID:   root,
+				InReplyTo: &event.InReplyTo{EventID: root},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := threadRelatesTo(tt.m, tt.root, tt.lastInfo, tt.replyToErrors)
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("threadRelatesTo() = %+v, want %+v", got, tt.want)
+			}
+			if got == nil {
+				return
+			}
+			if got.Type != tt.want.Type || got.EventID != tt.want.EventID {
+				t.Errorf("threadRelatesTo() = %+v, want %+v", got, tt.want)
+			}
+			if (got.InReplyTo == nil) != (tt.want.InReplyTo == nil) {
+				t.Errorf("InReplyTo = %+v, want %+v", got.InReplyTo, tt.want.InReplyTo)
+			} else if got.InReplyTo != nil && got.InReplyTo.EventID != tt.want.InReplyTo.EventID {
+				t.Errorf("InReplyTo.EventID = %q, want %q", got.InReplyTo.EventID, tt.want.InReplyTo.EventID)
+			}
+		})
+	}
+}
+
+func TestApplyThreadUpdate(t *testing.T) {
+	hook := &MHook{
+		threadRoots:   make(map[string]map[string]id.EventID),
+		lastInfoEvent: make(map[string]map[string]id.EventID),
+	}
+
+	hook.applyThreadUpdate(threadUpdate{roomID: "!room", key: "req-1", root: "$root"})
+	if got := hook.threadRoots["!room"]["req-1"]; got != "$root" {
+		t.Errorf("threadRoots[!room][req-1] = %q, want %q", got, "$root")
+	}
+	if got := hook.lastInfoEvent["!room"]["req-1"]; got != "" {
+		t.Errorf("lastInfoEvent should stay unset when ReplyToErrors is false, got %q", got)
+	}
+
+	hook.ReplyToErrors = true
+	hook.applyThreadUpdate(threadUpdate{roomID: "!room", key: "req-1", root: "$root", lastInfo: "$info1"})
+	if got := hook.lastInfoEvent["!room"]["req-1"]; got != "$info1" {
+		t.Errorf("lastInfoEvent[!room][req-1] = %q, want %q", got, "$info1")
+	}
+
+	// An update with no new root/lastInfo must not clobber what's recorded.
+	hook.applyThreadUpdate(threadUpdate{roomID: "!room", key: "req-1"})
+	if got := hook.threadRoots["!room"]["req-1"]; got != "$root" {
+		t.Errorf("threadRoots[!room][req-1] = %q, want unchanged %q", got, "$root")
+	}
+	if got := hook.lastInfoEvent["!room"]["req-1"]; got != "$info1" {
+		t.Errorf("lastInfoEvent[!room][req-1] = %q, want unchanged %q", got, "$info1")
+	}
+}
+
+func TestApplyThreadUpdateClearsInFlightMarker(t *testing.T) {
+	hook := &MHook{
+		threadRoots:    make(map[string]map[string]id.EventID),
+		lastInfoEvent:  make(map[string]map[string]id.EventID),
+		threadInFlight: make(map[string]map[string]bool),
+	}
+
+	hook.markThreadInFlight("!room", "req-1")
+	if !hook.threadInFlight["!room"]["req-1"] {
+		t.Fatal("markThreadInFlight() did not record the key as in-flight")
+	}
+
+	hook.applyThreadUpdate(threadUpdate{roomID: "!room", key: "req-1", root: "$root"})
+	if hook.threadInFlight["!room"]["req-1"] {
+		t.Error("applyThreadUpdate() should clear the in-flight marker once a send completes")
+	}
+}
+
+// TestEncryptMegolmEventResharesMissingSession exercises encryptMegolmEvent's
+// re-share-and-retry path. It uses a real OlmMachine with no outbound group
+// session for the room, which makes EncryptMegolmEvent return NoGroupSession
+// - one of the three errors crypto.IsShareError (and so SessionExpired, the
+// error a rotated-out session actually returns) is routed through the same
+// way encryptMegolmEvent re-shares a session once it expires.
+func TestEncryptMegolmEventResharesMissingSession(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ShareGroupSession always reports the new session via a to-device
+		// send, even to an empty set of devices - that's the only request
+		// re-sharing to an empty member list needs.
+		if r.Method != http.MethodPut || !strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/sendToDevice/") {
+			t.Errorf("unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mautrix.RespSendToDevice{})
+	}))
+	defer server.Close()
+
+	cli, err := mautrix.NewClient(server.URL, id.UserID("@matrus:localhost"), "test-token")
+	if err != nil {
+		t.Fatalf("mautrix.NewClient: %v", err)
+	}
+	cli.DeviceID = "TESTDEVICE"
+
+	cryptoStore := crypto.NewMemoryStore(nil)
+	stateStore := newMemberStateStore()
+	olmMachine := crypto.NewOlmMachine(cli, nil, cryptoStore, stateStore)
+	if err := olmMachine.Load(context.Background()); err != nil {
+		t.Fatalf("olmMachine.Load() error = %v", err)
+	}
+
+	const roomID id.RoomID = "!room:localhost"
+	stateStore.putRoom(roomID, nil, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+
+	hook := &MHook{olmMachine: olmMachine, stateStore: stateStore}
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}
+
+	if _, err := hook.encryptMegolmEvent(context.Background(), roomID, content); err != nil {
+		t.Fatalf("encryptMegolmEvent() error = %v, want it to auto re-share the missing session and succeed", err)
+	}
+
+	session, err := cryptoStore.GetOutboundGroupSession(context.Background(), roomID)
+	if err != nil {
+		t.Fatalf("GetOutboundGroupSession() error = %v", err)
+	}
+	if session == nil {
+		t.Error("encryptMegolmEvent() did not leave a shared outbound group session behind")
+	}
+}